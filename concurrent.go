@@ -0,0 +1,213 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Snapshot is an immutable, self-contained copy of a State's data for a
+// single frame. It is produced by a Snapshotter and rendered on its own
+// goroutine, so Render never reads data that Update is concurrently writing.
+type Snapshot interface {
+	Render() error
+}
+
+// Snapshotter is implemented by states that want to run under
+// RunConcurrent. Snapshot is called right after Update, on the goroutine
+// running React and Update, and must return a copy (or otherwise
+// race-free view) of whatever data the returned Snapshot's Render needs.
+type Snapshotter interface {
+	State
+	Snapshot() Snapshot
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RunConcurrent runs the loop like Run, but overlaps work across dedicated
+// goroutines: one runs React and Update at the fixed Step for the state on
+// top of the stack, the other runs Render on the Snapshots of the last
+// completed Update for every state on the stack, bottom to top. start, and
+// any state later pushed onto the stack, must implement Snapshotter. Goto,
+// Push, Pop, Replace and Stop may be called safely from either goroutine, or
+// from outside the loop entirely; the resulting transition is applied at
+// the next frame boundary of the React/Update goroutine.
+//
+// RunConcurrent does not apply the Options given to Configure, and does not
+// support FrameRateLimit, MinFrameInterval, RecordInputs, ReplayInputs or
+// Stats/OnStats: those are only wired into Run/RunContext's serial loop.
+func RunConcurrent(start State) (err error) {
+	transMu.Lock()
+	if len(stack) != 0 {
+		transMu.Unlock()
+		return errors.New("loop.RunConcurrent: already running")
+	}
+	transMu.Unlock()
+
+	if _, ok := start.(Snapshotter); !ok {
+		return errors.New("loop.RunConcurrent: start state does not implement Snapshotter")
+	}
+
+	start.Enter()
+	if err = start.React(); err == nil {
+		err = start.Update()
+	}
+
+	transMu.Lock()
+	stack = []State{start}
+	state = start
+	transMu.Unlock()
+	if err != nil {
+		transMu.Lock()
+		leave := drainStack()
+		state = nil
+		transMu.Unlock()
+		leaveStates(leave)
+		return err
+	}
+
+	frameTimeMu.Lock()
+	delta, lag = 0, 0
+	frameTimeMu.Unlock()
+
+	// Bounded channel of pending frames between the Update and the Render
+	// goroutine: its capacity is how far Render is allowed to lag behind.
+	frames := make(chan []Snapshot, 2)
+	// errCh carries the first error returned by React, Update or Render;
+	// it stops both goroutines.
+	errCh := make(chan error, 1)
+	// stopCh is closed the moment either goroutine hits a fatal error, so
+	// the other one can give up a blocking send/receive on frames instead
+	// of deadlocking against a peer that has already returned.
+	stopCh := make(chan struct{})
+	var stopOnce sync.Once
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go runUpdateLoop(&wg, frames, errCh, stopCh, &stopOnce)
+	go runRenderLoop(&wg, frames, errCh, stopCh, &stopOnce)
+
+	wg.Wait()
+
+	select {
+	case err = <-errCh:
+	default:
+	}
+
+	transMu.Lock()
+	leave := drainStack()
+	state = nil
+	transMu.Unlock()
+	leaveStates(leave)
+	return err
+}
+
+func runUpdateLoop(wg *sync.WaitGroup, frames chan<- []Snapshot, errCh chan<- error, stopCh chan struct{}, stopOnce *sync.Once) {
+	defer wg.Done()
+	defer close(frames)
+
+	t1 := clk.Now()
+	for {
+		transMu.Lock()
+		leave, enter := applyPending()
+		top := state
+		layers := append([]State(nil), stack...)
+		transMu.Unlock()
+		leaveStates(leave)
+		if enter != nil {
+			enter.Enter()
+		}
+		if top == nil {
+			return
+		}
+		cur, ok := top.(Snapshotter)
+		if !ok {
+			reportAndStop(errCh, stopCh, stopOnce, fmt.Errorf("loop.RunConcurrent: %T does not implement Snapshotter", top))
+			return
+		}
+
+		var err error
+		frameTimeMu.Lock()
+		behind := lag < step
+		frameTimeMu.Unlock()
+		if behind {
+			err = cur.React()
+		}
+		for err == nil {
+			frameTimeMu.Lock()
+			behind = lag >= step
+			if behind {
+				lag -= step
+			}
+			frameTimeMu.Unlock()
+			if !behind {
+				break
+			}
+			if err = cur.React(); err != nil {
+				break
+			}
+			err = cur.Update()
+		}
+		if err != nil {
+			reportAndStop(errCh, stopCh, stopOnce, err)
+			return
+		}
+
+		snaps := make([]Snapshot, len(layers))
+		for i, l := range layers {
+			ls, ok := l.(Snapshotter)
+			if !ok {
+				reportAndStop(errCh, stopCh, stopOnce, fmt.Errorf("loop.RunConcurrent: %T does not implement Snapshotter", l))
+				return
+			}
+			snaps[i] = ls.Snapshot()
+		}
+		select {
+		case frames <- snaps:
+		case <-stopCh:
+			return
+		}
+
+		t0 := t1
+		t1 = clk.Now()
+		frameTimeMu.Lock()
+		delta = t1.Sub(t0)
+		if delta > 4*step {
+			// Prevent "spiral of death" when Render cannot keep up with Update.
+			delta = 4 * step
+		}
+		lag += delta
+		frameTimeMu.Unlock()
+	}
+}
+
+func runRenderLoop(wg *sync.WaitGroup, frames <-chan []Snapshot, errCh chan<- error, stopCh chan struct{}, stopOnce *sync.Once) {
+	defer wg.Done()
+	for snaps := range frames {
+		for _, snap := range snaps {
+			if err := snap.Render(); err != nil {
+				reportAndStop(errCh, stopCh, stopOnce, err)
+				return
+			}
+		}
+	}
+}
+
+// reportAndStop delivers the first fatal error from either goroutine to
+// errCh, requests the loop to stop, and closes stopCh so the other
+// goroutine can give up on a blocking send/receive on frames instead of
+// deadlocking against a peer that already returned.
+func reportAndStop(errCh chan<- error, stopCh chan struct{}, stopOnce *sync.Once, err error) {
+	select {
+	case errCh <- err:
+	default:
+	}
+	stopOnce.Do(func() { close(stopCh) })
+	Stop()
+}
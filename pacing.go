@@ -0,0 +1,117 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import (
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// degradeAfter is the number of consecutive dry frames a rate limiter
+// tolerates before Run starts skipping Render to let Update catch up.
+const degradeAfter = 5
+
+// pacingState is a token bucket plus an optional hard floor on the interval
+// between frames.
+type pacingState struct {
+	mu sync.Mutex
+
+	enabled bool
+
+	rate   float64 // tokens per second; zero means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	minInterval time.Duration
+
+	overrunStreak int
+
+	// started marks whether tokens and last have been initialized. Run
+	// reapplies every configured Option every frame, so that
+	// initialization cannot live in FrameRateLimit's closure: it has to
+	// happen once, lazily, the first time reserve actually runs.
+	started bool
+}
+
+// pacing holds the state used to limit the frame rate of Run. It is disabled
+// (i.e. Run busy-loops as before) until FrameRateLimit or MinFrameInterval is
+// configured.
+var pacing pacingState
+
+// FrameRateLimit paces Run with a token-bucket rate limiter: tokens are
+// refilled at fps per second, up to burst tokens, and Run reserves one token
+// before each Render. When the bucket runs dry for more than a few
+// consecutive frames, Run degrades gracefully by skipping Render while still
+// running Update at the fixed Step, instead of spiralling further behind.
+func FrameRateLimit(fps float64, burst int) Option {
+	return func(*private) error {
+		pacing.mu.Lock()
+		pacing.enabled = true
+		pacing.rate = fps
+		pacing.burst = float64(burst)
+		pacing.mu.Unlock()
+		return nil
+	}
+}
+
+// MinFrameInterval paces Run by never reserving a frame less than d after the
+// previous one, regardless of any FrameRateLimit. It can be used on its own,
+// e.g. to cap the frame rate without the burstiness of a token bucket, or
+// together with FrameRateLimit as a hard floor.
+func MinFrameInterval(d time.Duration) Option {
+	return func(*private) error {
+		pacing.mu.Lock()
+		pacing.enabled = true
+		pacing.minInterval = d
+		pacing.mu.Unlock()
+		return nil
+	}
+}
+
+// reserve reports how long Run should sleep before Render, and whether
+// Render should be skipped this frame because the bucket has been empty for
+// too many frames in a row.
+func (p *pacingState) reserve(now time.Time) (sleep time.Duration, skip bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.enabled {
+		return 0, false
+	}
+
+	if !p.started {
+		p.started = true
+		p.tokens = p.burst
+		p.last = now
+	}
+	elapsed := now.Sub(p.last)
+	p.last = now
+
+	if p.rate > 0 {
+		p.tokens += elapsed.Seconds() * p.rate
+		if p.tokens > p.burst {
+			p.tokens = p.burst
+		}
+		if p.tokens >= 1 {
+			p.tokens--
+			p.overrunStreak = 0
+		} else {
+			p.overrunStreak++
+			if p.overrunStreak > degradeAfter {
+				p.tokens = 0
+				return 0, true
+			}
+			sleep = time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+			p.tokens = 0
+		}
+	}
+
+	if p.minInterval > sleep {
+		sleep = p.minInterval
+	}
+	return sleep, false
+}
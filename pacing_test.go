@@ -0,0 +1,57 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacingReserveThrottlesOnceBurstIsSpent(t *testing.T) {
+	var p pacingState
+	p.enabled = true
+	p.rate = 10
+	p.burst = 2
+
+	now := time.Unix(0, 0)
+	if sleep, skip := p.reserve(now); sleep != 0 || skip {
+		t.Fatalf("reservation 1: got sleep=%v skip=%v, want 0, false", sleep, skip)
+	}
+	if sleep, skip := p.reserve(now); sleep != 0 || skip {
+		t.Fatalf("reservation 2: got sleep=%v skip=%v, want 0, false", sleep, skip)
+	}
+
+	sleep, skip := p.reserve(now)
+	if skip {
+		t.Fatal("reservation 3: expected a sleep, not a skip")
+	}
+	if want := time.Second / 10; sleep < want-time.Millisecond || sleep > want+time.Millisecond {
+		t.Fatalf("reservation 3: got sleep=%v, want ~%v", sleep, want)
+	}
+}
+
+func TestPacingReserveDegradesAfterSustainedOverrun(t *testing.T) {
+	var p pacingState
+	p.enabled = true
+	p.rate = 10
+	p.burst = 1
+
+	now := time.Unix(0, 0)
+	p.reserve(now) // drains the single token
+
+	var skip bool
+	for i := 0; i <= degradeAfter; i++ {
+		_, skip = p.reserve(now) // now never advances: the bucket stays dry
+	}
+	if !skip {
+		t.Fatalf("expected reserve to skip Render after %d consecutive dry frames", degradeAfter)
+	}
+}
+
+func TestPacingReserveDisabledIsANoOp(t *testing.T) {
+	var p pacingState
+	if sleep, skip := p.reserve(time.Now()); sleep != 0 || skip {
+		t.Fatalf("disabled pacing should never sleep or skip, got sleep=%v skip=%v", sleep, skip)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import (
+	"encoding/gob"
+	"io"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Clock abstracts the wall clock used by Run to measure frame timing, so it
+// can be swapped for a virtualClock during replay or deterministic testing.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+var clk Clock = systemClock{}
+
+// virtualClock decouples Delta, Step and Lag from wall-clock time: every
+// call advances by exactly one Step, so a run driven by it always produces
+// the same sequence of frame timestamps.
+type virtualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(step)
+	return c.now
+}
+
+// VirtualClock makes Run advance its notion of time by exactly Step every
+// frame instead of measuring the wall clock, so Delta and Lag are fully
+// deterministic. ReplayInputs implies VirtualClock; use this option on its
+// own for deterministic tests that do not need a recorded input stream.
+func VirtualClock() Option {
+	return func(*private) error {
+		// Run reapplies every configured Option every frame: only install a
+		// fresh virtualClock if one is not already running, or every frame
+		// would restart the clock and collapse Delta to near zero.
+		if _, ok := clk.(*virtualClock); !ok {
+			clk = &virtualClock{}
+		}
+		return nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Event is one input event as consumed by a State's React. RecordInputs
+// timestamps it with the frame it was consumed on; ReplayInputs hands it
+// back on that same frame. Encoding Data is up to each State: the loop only
+// moves the bytes around.
+type Event struct {
+	Frame int
+	Data  []byte
+}
+
+var (
+	frameNumber int
+
+	recorder *gob.Encoder
+
+	replayer    *gob.Decoder
+	replayQueue []Event
+)
+
+// RecordInputs makes RecordEvent timestamp every event it is given with the
+// current frame number and serialize it to w, so a later run can reproduce
+// them with ReplayInputs.
+//
+// frameNumber, and so RecordInputs/ReplayInputs, is only advanced by
+// Run/RunContext's serial loop: RunConcurrent does not support recording
+// or replaying input.
+func RecordInputs(w io.Writer) Option {
+	return func(*private) error {
+		// Run reapplies every configured Option every frame: only install
+		// the encoder once, or a fresh one each frame would corrupt the
+		// gob stream.
+		if recorder == nil {
+			recorder = gob.NewEncoder(w)
+		}
+		return nil
+	}
+}
+
+// ReplayInputs switches Run to a VirtualClock and makes NextEvent return,
+// in order, the events previously serialized by RecordInputs, each on the
+// frame number it was recorded on. Together, this makes the run fully
+// deterministic: same Step advance, same events, same frame numbers.
+//
+// As with RecordInputs, this is only supported under Run/RunContext.
+func ReplayInputs(r io.Reader) Option {
+	return func(*private) error {
+		// Run reapplies every configured Option every frame: only install
+		// the decoder and queue once, or a fresh one each frame would
+		// silently drop every event re-decoded from the start of r.
+		if replayer == nil {
+			replayer = gob.NewDecoder(r)
+			replayQueue = nil
+		}
+		if _, ok := clk.(*virtualClock); !ok {
+			clk = &virtualClock{}
+		}
+		return nil
+	}
+}
+
+// RecordEvent timestamps data with the current frame number and appends it
+// to the stream started by RecordInputs; it is a no-op if recording is not
+// enabled. States call it from React for every input they consume.
+func RecordEvent(data []byte) {
+	if recorder == nil {
+		return
+	}
+	_ = recorder.Encode(Event{Frame: frameNumber, Data: data})
+}
+
+// NextEvent returns the next event recorded on the current frame, and
+// whether one was available; it is driven by ReplayInputs. States call it
+// from React instead of reading their usual input source.
+func NextEvent() (Event, bool) {
+	if replayer == nil {
+		return Event{}, false
+	}
+	for len(replayQueue) == 0 {
+		var e Event
+		if err := replayer.Decode(&e); err != nil {
+			return Event{}, false
+		}
+		replayQueue = append(replayQueue, e)
+	}
+	if replayQueue[0].Frame != frameNumber {
+		return Event{}, false
+	}
+	e := replayQueue[0]
+	replayQueue = replayQueue[1:]
+	return e, true
+}
@@ -0,0 +1,49 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestVirtualClockAdvancesByStep(t *testing.T) {
+	c := &virtualClock{}
+	first := c.Now()
+	second := c.Now()
+	if got := second.Sub(first); got != step {
+		t.Fatalf("Now advanced by %v, want %v", got, step)
+	}
+}
+
+func TestRecordReplayRoundTrip(t *testing.T) {
+	defer func() {
+		recorder, replayer, replayQueue = nil, nil, nil
+	}()
+
+	var buf bytes.Buffer
+	recorder = gob.NewEncoder(&buf)
+	for i := 0; i < 3; i++ {
+		frameNumber = i
+		RecordEvent([]byte{byte(i)})
+	}
+	recorder = nil
+
+	replayer = gob.NewDecoder(&buf)
+	replayQueue = nil
+	for i := 0; i < 3; i++ {
+		frameNumber = i
+		e, ok := NextEvent()
+		if !ok {
+			t.Fatalf("frame %d: expected an event", i)
+		}
+		if len(e.Data) != 1 || int(e.Data[0]) != i {
+			t.Fatalf("frame %d: got %v, want [%d]", i, e.Data, i)
+		}
+	}
+	if _, ok := NextEvent(); ok {
+		t.Fatal("expected no more events past the recorded stream")
+	}
+}
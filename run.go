@@ -4,42 +4,24 @@
 package loop
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"time"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// State represents a state of the loop.
+// State represents a state of the loop. React, Update and Render may return
+// an error to abort the loop: RunContext then calls Leave on the current
+// state and returns that error. States written before errors existed can be
+// adapted with StateFunc.
 type State interface {
 	Enter()
 	Leave()
-	React()
-	Update()
-	Render()
-}
-
-////////////////////////////////////////////////////////////////////////////////
-
-var (
-	state State
-	next  State
-)
-
-// Running returns true if the loop is running, i.e. when called from inside
-// loop.Run.
-func Running() bool {
-	return state != nil
-}
-
-// Goto changes the loop state. The change takes place at next frame.
-func Goto(l State) {
-	next = l
-}
-
-// Stop requests the loop to stop.
-func Stop() {
-	next = nil
+	React() error
+	Update() error
+	Render() error
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -48,6 +30,11 @@ var (
 	step  = time.Second / 60
 	delta time.Duration
 	lag   time.Duration
+
+	// frameTimeMu guards delta and lag, since RunConcurrent writes them
+	// from its React/Update goroutine while Delta and Lag may be called
+	// from its Render goroutine.
+	frameTimeMu sync.Mutex
 )
 
 // Step returns the time between two consecutive updates. It is a
@@ -66,115 +53,185 @@ func TimeStep(s time.Duration) Option {
 }
 
 // Delta returns the time elapsed between the frame to be rendered
-// and the previous one.
+// and the previous one. It is safe to call from any goroutine, including
+// a Snapshot's Render under RunConcurrent, but under RunConcurrent the
+// value may already belong to a later frame than the one being rendered;
+// callers needing exact correspondence should capture Delta themselves in
+// Snapshotter.Snapshot and carry it on their Snapshot.
 //
 // See also Step and Lag.
 func Delta() time.Duration {
+	frameTimeMu.Lock()
+	defer frameTimeMu.Unlock()
 	return delta
 }
 
 // Lag returns the time elapsed between the last Update and the frame
 // being rendered. It should be used during Render to extrapolate (or
-// interpolate) the game state.
+// interpolate) the game state. The same caveat as Delta applies under
+// RunConcurrent.
 //
 // See also Step and Delta.
 func Lag() time.Duration {
+	frameTimeMu.Lock()
+	defer frameTimeMu.Unlock()
 	return lag
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// Run the loop.
-func Run(start State) (err error) {
-	if state != nil {
-		return errors.New("loop.Run: already running")
+// Run runs the loop like RunContext, but without support for cancellation
+// through a context; it is kept for states and callers that predate
+// RunContext.
+func Run(start State) error {
+	return RunContext(context.Background(), start)
+}
+
+// RunContext runs the loop, starting with start, until a state calls Stop,
+// an error is returned by React, Update or Render, or ctx is canceled.
+// Whichever way it stops, Leave is called on every state still on the
+// stack, top to bottom, and RunContext returns the error that caused the
+// stop (nil for a plain Stop).
+func RunContext(ctx context.Context, start State) (err error) {
+	transMu.Lock()
+	if len(stack) != 0 {
+		transMu.Unlock()
+		return errors.New("loop.RunContext: already running")
 	}
+	transMu.Unlock()
 
 	// Start
 	start.Enter()
-	start.React()
-	start.Update()
-	next = start
+	if err = start.React(); err == nil {
+		err = start.Update()
+	}
+	transMu.Lock()
+	stack = []State{start}
+	state = start
+	transMu.Unlock()
+	if err != nil {
+		transMu.Lock()
+		leave := drainStack()
+		state = nil
+		transMu.Unlock()
+		leaveStates(leave)
+		return err
+	}
+
+	// Apply configuration once before the timing baseline below is
+	// established, so a Clock installed by an Option (e.g. VirtualClock)
+	// is already in effect for t0 instead of t0 being measured against
+	// whatever clock was in effect before this run was configured.
+	for _, o := range options {
+		if err = o(&private{}); err != nil {
+			transMu.Lock()
+			leave := drainStack()
+			state = nil
+			transMu.Unlock()
+			leaveStates(leave)
+			return err
+		}
+	}
 
-	t0 := time.Now()
+	t0 := clk.Now()
 	t1 := t0
+	frameTimeMu.Lock()
 	delta, lag = 0, 0
+	frameTimeMu.Unlock()
+	frameNumber = 0
 
 	// Loop
-	for next != nil {
-		state = next
+	for {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+
+		transMu.Lock()
+		leave, enter := applyPending()
+		top := state
+		layers := append([]State(nil), stack...)
+		transMu.Unlock()
+		leaveStates(leave)
+		if enter != nil {
+			enter.Enter()
+		}
+		if top == nil {
+			break
+		}
 
 		// Apply any pending configuration
 		for _, o := range options {
-			err := o(&private{})
-			if err != nil {
-				return err
+			if err = o(&private{}); err != nil {
+				break
 			}
 		}
+		if err != nil {
+			break
+		}
 
-		// React, and (maybe) Update
+		// React, and (maybe) Update, on the state at the top of the stack
 		if lag < step {
-			state.React()
+			tr := time.Now()
+			err = top.React()
+			phaseAccum.react.add(time.Since(tr))
 		}
-		for lag >= step {
+		for err == nil && lag >= step {
+			frameTimeMu.Lock()
 			lag -= step
-			state.React()
-			state.Update()
+			frameTimeMu.Unlock()
+			tr := time.Now()
+			err = top.React()
+			phaseAccum.react.add(time.Since(tr))
+			if err != nil {
+				break
+			}
+			tu := time.Now()
+			err = top.Update()
+			phaseAccum.update.add(time.Since(tu))
+		}
+		if err != nil {
+			break
 		}
 
-		// Render
-		state.Render()
+		// Render every state on the stack, bottom to top, paced by any
+		// configured rate limiter
+		sleep, skip := pacing.reserve(time.Now())
+		if sleep > 0 {
+			time.Sleep(sleep)
+		}
+		if !skip {
+			tr := time.Now()
+			for _, l := range layers {
+				if err = l.Render(); err != nil {
+					break
+				}
+			}
+			phaseAccum.render.add(time.Since(tr))
+		}
+		if err != nil {
+			break
+		}
 
 		t0 = t1
-		t1 = time.Now()
+		t1 = clk.Now()
+		frameTimeMu.Lock()
 		delta = t1.Sub(t0)
-		stats()
 		if delta > 4*step {
 			// Prevent "spiral of death" when Render cannot keep up with Update
 			delta = 4 * step
 		}
 		lag += delta
+		frameTimeMu.Unlock()
+		frameNumber++
+		stats()
 	}
 
-	// Stop
-	state.Leave()
+	transMu.Lock()
+	leave := drainStack()
 	state = nil
-	return nil
-}
+	transMu.Unlock()
+	leaveStates(leave)
 
-////////////////////////////////////////////////////////////////////////////////
-
-const (
-	statsInterval = time.Second / 4
-	xrunThreshold = 17 * time.Millisecond
-)
-
-var (
-	frametime float64
-	xruns     int
-	interval  struct {
-		frames int
-		time   time.Duration
-		xruns  int
-	}
-)
-
-// Stats returns the frametime durations of frames; it is updated 4 times per
-// second. It also returns the number of overruns (i.e. frame time longer than
-// the threshold) during the last measurment interval.
-func Stats() (frametime float64, overruns int) {
-	return frametime, xruns
-}
-
-func stats() {
-	interval.frames++
-	interval.time += delta
-	if delta > xrunThreshold {
-		interval.xruns++
-	}
-	if interval.time >= statsInterval {
-		frametime = float64(interval.time) / float64(interval.frames)
-		xruns = interval.xruns
-		interval.time, interval.frames, interval.xruns = 0, 0, 0
-	}
+	return err
 }
@@ -0,0 +1,44 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+////////////////////////////////////////////////////////////////////////////////
+
+// LegacyState is the shape of State before React, Update and Render could
+// return an error. It exists so states written against that older State can
+// be adapted with StateFunc instead of being rewritten.
+type LegacyState interface {
+	Enter()
+	Leave()
+	React()
+	Update()
+	Render()
+}
+
+// StateFunc adapts a LegacyState into a State whose React, Update and
+// Render always return a nil error, so pre-existing states keep working
+// unchanged with Run and RunContext. The adapted State does not implement
+// Snapshotter, so RunConcurrent rejects it.
+func StateFunc(s LegacyState) State {
+	return legacyState{s}
+}
+
+type legacyState struct {
+	LegacyState
+}
+
+func (s legacyState) React() error {
+	s.LegacyState.React()
+	return nil
+}
+
+func (s legacyState) Update() error {
+	s.LegacyState.Update()
+	return nil
+}
+
+func (s legacyState) Render() error {
+	s.LegacyState.Render()
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import "sync"
+
+////////////////////////////////////////////////////////////////////////////////
+
+// transMu guards the state stack and the pending transition below, so that
+// Goto, Push, Pop, Replace and Stop can be called safely from any goroutine,
+// including while RunConcurrent is running.
+var transMu sync.Mutex
+
+// stack holds the states currently running, bottom to top: every state in it
+// is Rendered each frame, but only the one on top gets React and Update.
+// Pushing an overlay (e.g. a pause menu) on top therefore freezes Update on
+// the states below it without hiding them.
+var stack []State
+
+// state is the state on top of stack, i.e. the one currently receiving
+// React and Update; it is nil when the loop is not running.
+var state State
+
+type transition int
+
+const (
+	noTransition transition = iota
+	gotoTransition
+	pushTransition
+	popTransition
+	replaceTransition
+	stopTransition
+)
+
+var (
+	pending      transition
+	pendingState State
+)
+
+// Running returns true if the loop is running, i.e. when called from inside
+// loop.Run or loop.RunConcurrent.
+func Running() bool {
+	transMu.Lock()
+	defer transMu.Unlock()
+	return state != nil
+}
+
+// Goto discards the whole state stack and starts over with l as its only,
+// bottom state. The change takes place at the next frame boundary.
+func Goto(l State) {
+	transMu.Lock()
+	pending, pendingState = gotoTransition, l
+	transMu.Unlock()
+}
+
+// Push adds l on top of the state stack: l starts receiving React, Update
+// and Render, while the states below it are still Rendered but no longer
+// Updated until l is popped or replaced. The change, including l.Enter,
+// takes place at the next frame boundary.
+func Push(l State) {
+	transMu.Lock()
+	pending, pendingState = pushTransition, l
+	transMu.Unlock()
+}
+
+// Pop removes the state on top of the stack, calling its Leave, and resumes
+// Update on the state now on top. The change takes place at the next frame
+// boundary.
+func Pop() {
+	transMu.Lock()
+	pending, pendingState = popTransition, nil
+	transMu.Unlock()
+}
+
+// Replace swaps the state on top of the stack for l, without disturbing the
+// states below it: the current top's Leave is called, then l.Enter. The
+// change takes place at the next frame boundary.
+func Replace(l State) {
+	transMu.Lock()
+	pending, pendingState = replaceTransition, l
+	transMu.Unlock()
+}
+
+// Stop requests the loop to stop: every state still on the stack gets its
+// Leave called, top to bottom, at the next frame boundary.
+func Stop() {
+	transMu.Lock()
+	pending, pendingState = stopTransition, nil
+	transMu.Unlock()
+}
+
+// applyPending applies any transition requested since the last frame to the
+// stack, and refreshes state to the new top. Callers must hold transMu.
+//
+// It only ever touches the stack bookkeeping: it does not call Enter or
+// Leave itself, since those are user code that may call Goto, Push, Pop,
+// Replace or Stop right back, which would deadlock on transMu. Instead it
+// returns the states to call Leave on, top to bottom, and the state (if
+// any) to call Enter on; the caller must invoke them, in that order, only
+// after releasing transMu.
+func applyPending() (leave []State, enter State) {
+	switch pending {
+	case gotoTransition:
+		leave = drainStack()
+		enter = pendingState
+		stack = []State{pendingState}
+	case pushTransition:
+		enter = pendingState
+		stack = append(stack, pendingState)
+	case popTransition:
+		leave = popTop()
+	case replaceTransition:
+		leave = popTop()
+		enter = pendingState
+		stack = append(stack, pendingState)
+	case stopTransition:
+		leave = drainStack()
+	}
+	pending, pendingState = noTransition, nil
+
+	if len(stack) > 0 {
+		state = stack[len(stack)-1]
+	} else {
+		state = nil
+	}
+	return leave, enter
+}
+
+// popTop removes the top of stack and returns it as a single-element slice,
+// or nil if the stack is empty. Callers must hold transMu.
+func popTop() []State {
+	if len(stack) == 0 {
+		return nil
+	}
+	top := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+	return []State{top}
+}
+
+// drainStack empties stack and returns its former contents top to bottom,
+// the order Leave must be called in. Callers must hold transMu.
+func drainStack() []State {
+	leave := make([]State, len(stack))
+	for i, s := range stack {
+		leave[len(stack)-1-i] = s
+	}
+	stack = nil
+	return leave
+}
+
+// leaveStates calls Leave on every state in leave, in order. Callers must
+// not hold transMu.
+func leaveStates(leave []State) {
+	for _, s := range leave {
+		s.Leave()
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2013-2019 Laurent Moussault <laurent.moussault@gmail.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package loop
+
+import (
+	"math/bits"
+	"sort"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// statsRingSize is the number of past frames kept to compute percentiles and
+// the histogram over each statsInterval.
+const statsRingSize = 256
+
+// histogramBuckets is the number of buckets in FrameStats.Histogram; bucket i
+// covers [2^(i-1), 2^i) microseconds, so 32 buckets reach 2^31us (about 36
+// minutes); longer frames are counted in the last bucket.
+const histogramBuckets = 32
+
+// PhaseStats summarizes the time spent in one phase (React, Update or
+// Render) of Run over the last statsInterval.
+type PhaseStats struct {
+	Min, Max, Mean time.Duration
+}
+
+// FrameStats summarizes frame timing over the last statsInterval: overall
+// min/max/mean, p50/p95/p99 percentiles, a log-bucketed histogram of frame
+// durations, and a per-phase breakdown so jank can be attributed to React,
+// Update or Render.
+type FrameStats struct {
+	Min, Max, Mean time.Duration
+	P50, P95, P99  time.Duration
+	Overruns       int
+	Histogram      [histogramBuckets]int
+
+	React, Update, Render PhaseStats
+}
+
+var (
+	statsInterval = time.Second / 4
+	xrunThreshold = 17 * time.Millisecond
+
+	onStats func(FrameStats)
+
+	lastStats FrameStats
+
+	statsRing  [statsRingSize]time.Duration
+	statsCount int
+
+	intervalTime  time.Duration
+	intervalXruns int
+
+	phaseAccum struct {
+		react, update, render phaseAccumulator
+	}
+)
+
+type phaseAccumulator struct {
+	min, max, sum time.Duration
+	n             int
+}
+
+func (p *phaseAccumulator) add(d time.Duration) {
+	if p.n == 0 || d < p.min {
+		p.min = d
+	}
+	if d > p.max {
+		p.max = d
+	}
+	p.sum += d
+	p.n++
+}
+
+func (p *phaseAccumulator) stats() PhaseStats {
+	if p.n == 0 {
+		return PhaseStats{}
+	}
+	return PhaseStats{Min: p.min, Max: p.max, Mean: p.sum / time.Duration(p.n)}
+}
+
+func (p *phaseAccumulator) reset() {
+	*p = phaseAccumulator{}
+}
+
+// StatsInterval sets how often Stats is refreshed and OnStats is called; it
+// defaults to 250ms.
+func StatsInterval(d time.Duration) Option {
+	return func(*private) error {
+		statsInterval = d
+		return nil
+	}
+}
+
+// XrunThreshold sets the frame duration above which a frame counts towards
+// FrameStats.Overruns; it defaults to 17ms.
+func XrunThreshold(d time.Duration) Option {
+	return func(*private) error {
+		xrunThreshold = d
+		return nil
+	}
+}
+
+// OnStats registers f to be called every StatsInterval with the FrameStats
+// measured over that interval, e.g. to pipe them to a logger, a HUD or a
+// metrics endpoint.
+func OnStats(f func(FrameStats)) Option {
+	return func(*private) error {
+		onStats = f
+		return nil
+	}
+}
+
+// Stats returns the FrameStats measured over the last StatsInterval.
+func Stats() FrameStats {
+	return lastStats
+}
+
+// bucket returns the Histogram index d falls into.
+func bucket(d time.Duration) int {
+	us := d.Microseconds()
+	if us < 1 {
+		us = 1
+	}
+	b := bits.Len64(uint64(us))
+	if b >= histogramBuckets {
+		b = histogramBuckets - 1
+	}
+	return b
+}
+
+// stats folds the just-rendered frame's delta into the current interval,
+// and, once statsInterval has elapsed, computes the FrameStats for it.
+func stats() {
+	if statsCount < statsRingSize {
+		statsRing[statsCount] = delta
+	}
+	statsCount++
+	intervalTime += delta
+	if delta > xrunThreshold {
+		intervalXruns++
+	}
+
+	if intervalTime < statsInterval {
+		return
+	}
+
+	n := statsCount
+	if n > statsRingSize {
+		n = statsRingSize
+	}
+	samples := append([]time.Duration(nil), statsRing[:n]...)
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var fs FrameStats
+	if n > 0 {
+		var sum time.Duration
+		for _, s := range samples {
+			sum += s
+			fs.Histogram[bucket(s)]++
+		}
+		fs.Min = samples[0]
+		fs.Max = samples[n-1]
+		fs.Mean = sum / time.Duration(n)
+		fs.P50 = percentile(samples, 0.50)
+		fs.P95 = percentile(samples, 0.95)
+		fs.P99 = percentile(samples, 0.99)
+	}
+	fs.Overruns = intervalXruns
+	fs.React = phaseAccum.react.stats()
+	fs.Update = phaseAccum.update.stats()
+	fs.Render = phaseAccum.render.stats()
+
+	lastStats = fs
+	if onStats != nil {
+		onStats(fs)
+	}
+
+	statsCount, intervalTime, intervalXruns = 0, 0, 0
+	phaseAccum.react.reset()
+	phaseAccum.update.reset()
+	phaseAccum.render.reset()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}